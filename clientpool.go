@@ -4,7 +4,11 @@ import (
 	"errors"
 	"sync"
 
+	"context"
+	"crypto/tls"
+	"io"
 	"math/rand"
+	"net"
 	"reflect"
 	"time"
 
@@ -16,6 +20,7 @@ import (
 var (
 	ErrPoolClosed                  = errors.New("pool has been closed")
 	ErrPoolMaxOpenReached          = errors.New("pool max open client limit reached")
+	ErrNoServers                   = errors.New("pool has no servers configured")
 	ErrClientMissingTransportField = errors.New("client missing transport field")
 	ErrClientNilTransportField     = errors.New("client transport field is nil")
 	errNoPooledClient              = errors.New("No pooled client")
@@ -25,7 +30,18 @@ type Client interface{}
 type PooledClient interface {
 	Close() error
 	RawClient() Client
+	// MarkUnusable marks the connection not usable any more, so the pool
+	// closes it instead of returning it to the pool on Close(). Prefer
+	// Do(), which calls this for you; call MarkUnusable directly only when
+	// you have a reason Do()'s classification doesn't cover.
 	MarkUnusable()
+	// Do runs fn against the pooled client and automatically marks the
+	// client unusable if fn returns a transport-level error (a broken pipe,
+	// timeout, or EOF). This is the supported way to call RPC methods
+	// through the pool: calling methods directly on RawClient()/the
+	// embedded Client bypasses this classification, leaving you back at
+	// having to call MarkUnusable() yourself on error.
+	Do(fn func(Client) error) error
 }
 
 // client pool interface
@@ -38,26 +54,302 @@ type ClientPool interface {
 	Size() int
 }
 
-type ClientFactory func(openedSocket thrift.TTransport) Client
+// ClientWithTransport pairs a service Client with the transport it was
+// built on, so the pool can close exactly that transport later without
+// reaching into the generated client struct via reflection.
+type ClientWithTransport struct {
+	Client    Client
+	Transport thrift.TTransport
+}
+
+// ClientFactory builds a service Client on top of a dialed transport and
+// reports back the (possibly further-wrapped, e.g. framed or multiplexed)
+// transport the client actually uses, so the pool knows exactly what to
+// close. The transport argument has already been passed through the
+// pool's TTransportFactory (if one is configured).
+type ClientFactory func(transport thrift.TTransport) ClientWithTransport
+
+// LegacyClientFactory is the pool's original factory shape: it returns
+// only a Client, leaving the pool to discover the client's Transport field
+// via reflection in order to close it.
+//
+// Deprecated: implement ClientFactory directly and report the transport
+// explicitly instead.
+type LegacyClientFactory func(transport thrift.TTransport) Client
+
+// WrapLegacyClientFactory adapts a LegacyClientFactory to ClientFactory by
+// reflecting into the returned client's Transport field, preserving the
+// pool's original (fragile, codegen-shape-dependent) behavior for callers
+// who haven't migrated yet.
+//
+// Deprecated: this exists only to ease migration off LegacyClientFactory;
+// prefer implementing ClientFactory directly.
+func WrapLegacyClientFactory(factory LegacyClientFactory) ClientFactory {
+	return func(transport thrift.TTransport) ClientWithTransport {
+		cli := factory(transport)
+		clientTransport, err := reflectClientTransport(cli)
+		if err != nil {
+			// Fall back to the transport we were given; it is at worst a
+			// less-wrapped view of the same underlying connection, and
+			// closing it still releases the connection.
+			clientTransport = transport
+		}
+		return ClientWithTransport{Client: cli, Transport: clientTransport}
+	}
+}
+
+// reflectClientTransport recovers cli's Transport field via reflection, the
+// way the pool used to do for every client before ClientFactory started
+// reporting the transport explicitly. It is fragile against Thrift codegen
+// changes (see THRIFT-4285) and is retained only for WrapLegacyClientFactory.
+func reflectClientTransport(cli Client) (thrift.TTransport, error) {
+	v := reflect.ValueOf(cli).Elem().FieldByName("Transport")
+	if !v.IsValid() {
+		return nil, ErrClientMissingTransportField
+	}
+	if v.IsNil() {
+		return nil, ErrClientNilTransportField
+	}
+	transport, ok := v.Interface().(thrift.TTransport)
+	if !ok {
+		return nil, ErrClientMissingTransportField
+	}
+	return transport, nil
+}
+
+// Dialer opens a transport to server, applying connectTimeout while
+// establishing the connection and readTimeout to subsequent reads. It
+// replaces the pool's old hardcoded thrift.NewTSocket dialing, letting
+// callers plug in TLS, Unix-domain sockets, or any other transport.
+type Dialer func(server string, connectTimeout, readTimeout time.Duration) (thrift.TTransport, error)
+
+// TCPDialer is the pool's default Dialer: a plain thrift.TSocket over TCP.
+func TCPDialer(server string, connectTimeout, readTimeout time.Duration) (thrift.TTransport, error) {
+	socket, err := thrift.NewTSocket(server)
+	if err != nil {
+		return nil, err
+	}
+	socket.SetTimeout(connectTimeout)
+	if err := socket.Open(); err != nil {
+		return nil, err
+	}
+	socket.SetTimeout(readTimeout)
+	return socket, nil
+}
+
+// TLSDialer returns a Dialer that opens a TLS connection to server using
+// tlsConfig.
+func TLSDialer(tlsConfig *tls.Config) Dialer {
+	return func(server string, connectTimeout, readTimeout time.Duration) (thrift.TTransport, error) {
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: connectTimeout}, "tcp", server, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		return thrift.NewTSocketFromConnTimeout(conn, readTimeout), nil
+	}
+}
+
+// UnixDialer returns a Dialer that connects to a Unix domain socket at the
+// path given as the server address.
+func UnixDialer() Dialer {
+	return func(server string, connectTimeout, readTimeout time.Duration) (thrift.TTransport, error) {
+		conn, err := net.DialTimeout("unix", server, connectTimeout)
+		if err != nil {
+			return nil, err
+		}
+		return thrift.NewTSocketFromConnTimeout(conn, readTimeout), nil
+	}
+}
 
+// NewMultiplexedProtocol wraps transport's protocol in a
+// TMultiplexedProtocol addressed to serviceName, for use inside a
+// ClientFactory that talks to a TMultiplexedProcessor on the server side.
+func NewMultiplexedProtocol(transport thrift.TTransport, protocolFactory thrift.TProtocolFactory, serviceName string) thrift.TProtocol {
+	return thrift.NewTMultiplexedProtocol(protocolFactory.GetProtocol(transport), serviceName)
+}
+
+// SelectionPolicy picks which backend server a Get() call should be routed
+// to. outstanding reports the number of clients of a given server that are
+// currently checked out of the pool, which lets policies such as
+// LeastActivePolicy balance load across the server set.
+type SelectionPolicy interface {
+	Select(servers []string, outstanding func(server string) int32) string
+}
+
+// RandomPolicy picks a server uniformly at random. This was the pool's
+// original, and still default-adjacent, behavior.
+type RandomPolicy struct{}
+
+func (RandomPolicy) Select(servers []string, outstanding func(server string) int32) string {
+	return servers[rand.Intn(len(servers))]
+}
+
+// RoundRobinPolicy cycles through servers in list order.
+type RoundRobinPolicy struct {
+	next uint32
+}
+
+func (p *RoundRobinPolicy) Select(servers []string, outstanding func(server string) int32) string {
+	i := atomic.AddUint32(&p.next, 1) - 1
+	return servers[int(i)%len(servers)]
+}
+
+// LeastActivePolicy picks the server with the fewest clients currently
+// checked out of the pool, ties broken in server list order. This mirrors
+// the least-active-request balancing thriftset performs over a discovered
+// server set.
+type LeastActivePolicy struct{}
+
+func (LeastActivePolicy) Select(servers []string, outstanding func(server string) int32) string {
+	best := servers[0]
+	bestCount := outstanding(best)
+	for _, server := range servers[1:] {
+		if count := outstanding(server); count < bestCount {
+			best = server
+			bestCount = count
+		}
+	}
+	return best
+}
+
+// ServerSet abstracts the backend server membership a pool draws from, so
+// users can plug in Zookeeper/etcd/Consul/DNS-based discovery instead of a
+// fixed address list. Notify returns a channel that fires with the full,
+// current membership list whenever it changes; implementations that never
+// change membership may return a nil channel.
+type ServerSet interface {
+	Servers() []string
+	Notify() <-chan []string
+}
+
+// StaticServerSet is a ServerSet over a fixed address list that never
+// changes, preserving the pool's original behavior for callers who don't
+// need discovery.
+type StaticServerSet struct {
+	servers []string
+}
+
+func NewStaticServerSet(servers []string) *StaticServerSet {
+	return &StaticServerSet{servers: servers}
+}
+
+func (s *StaticServerSet) Servers() []string {
+	return s.servers
+}
+
+func (s *StaticServerSet) Notify() <-chan []string {
+	return nil
+}
+
+// ChannelClientPool pools thrift clients per backend host: idle clients are
+// bucketed by the server address they were dialed against, and Get() uses
+// the configured SelectionPolicy (LeastActivePolicy by default) to pick a
+// host, only reusing an idle connection to that host or dialing a new one
+// if none is idle. This avoids handing a caller expecting server B a
+// connection that was checked in by server A.
 type ChannelClientPool struct {
-	mu      sync.Mutex
-	clients chan Client
+	mu          sync.Mutex
+	clients     map[string]chan *idleClient
+	outstanding map[string]*int32
+
+	opened           uint32
+	maxIdle          uint32
+	maxOpen          uint32
+	maxIdleTime      time.Duration
+	maxLifetime      time.Duration
+	serverSet        ServerSet
+	servers          []string
+	policy           SelectionPolicy
+	connectTimeout   time.Duration
+	readTimeout      time.Duration
+	clientFactory    ClientFactory
+	pingFunc         PingFunc
+	dialer           Dialer
+	transportFactory thrift.TTransportFactory
+
+	reapStop chan struct{}
+	reapDone chan struct{}
+
+	watchStop chan struct{}
+	watchDone chan struct{}
 
-	opened         uint32
-	maxIdle        uint32
-	maxOpen        uint32
-	servers        []string
-	connectTimeout time.Duration
-	readTimeout    time.Duration
-	clientFactory  ClientFactory
+	// waiters holds pending GetContext callers blocked on a maxOpen slot,
+	// in FIFO order.
+	waiters []chan struct{}
+}
+
+// PoolOption configures optional ChannelClientPool behavior beyond its
+// required constructor arguments.
+type PoolOption func(*ChannelClientPool)
+
+// WithMaxIdleTime discards (and closes) a pooled client that has sat idle
+// for longer than d instead of handing it back out, guarding against
+// connections silently reset by load balancers or peers while parked. A
+// zero duration (the default) disables idle expiry.
+func WithMaxIdleTime(d time.Duration) PoolOption {
+	return func(pool *ChannelClientPool) {
+		pool.maxIdleTime = d
+	}
+}
+
+// WithMaxLifetime closes a pooled client once it has existed for longer
+// than d, regardless of idle time. A zero duration (the default) disables
+// lifetime expiry.
+func WithMaxLifetime(d time.Duration) PoolOption {
+	return func(pool *ChannelClientPool) {
+		pool.maxLifetime = d
+	}
+}
+
+// PingFunc health-checks a client pulled out of the idle pool before it is
+// handed to a caller. A non-nil error causes the pool to close that client
+// and transparently dial a fresh one instead of serving a possibly-dead
+// connection.
+type PingFunc func(Client) error
+
+// WithPingFunc installs a PingFunc run against every client fetched from
+// the idle pool, guarding against connections silently reset by a load
+// balancer or peer while parked.
+func WithPingFunc(fn PingFunc) PoolOption {
+	return func(pool *ChannelClientPool) {
+		pool.pingFunc = fn
+	}
+}
+
+// WithDialer overrides how the pool opens new connections. The default is
+// TCPDialer; use TLSDialer or UnixDialer for TLS or Unix-domain backends.
+func WithDialer(dialer Dialer) PoolOption {
+	return func(pool *ChannelClientPool) {
+		pool.dialer = dialer
+	}
+}
+
+// WithTransportFactory applies factory to every transport the pool dials,
+// before it reaches ClientFactory, for buffering/framing/multiplexing that
+// would otherwise have to be redone inside every ClientFactory.
+func WithTransportFactory(factory thrift.TTransportFactory) PoolOption {
+	return func(pool *ChannelClientPool) {
+		pool.transportFactory = factory
+	}
+}
+
+// idleClient is a pooled Client together with the bookkeeping needed to
+// expire it once it has been idle or alive too long.
+type idleClient struct {
+	client     Client
+	transport  thrift.TTransport
+	createdAt  time.Time
+	lastUsedAt time.Time
 }
 
 // thrift service client wrapped with pool manage information
 type pooledClient struct {
 	Client
-	pool     *ChannelClientPool
-	unusable bool
+	pool      *ChannelClientPool
+	server    string
+	transport thrift.TTransport
+	createdAt time.Time
+	unusable  bool
 }
 
 func (cli *pooledClient) Close() error {
@@ -73,130 +365,537 @@ func (cli *pooledClient) MarkUnusable() {
 	cli.unusable = true
 }
 
-func NewChannelClientPool(maxIdle, maxOpen uint32, servers []string, connectTimeout, readTimeout time.Duration, clientFactory ClientFactory) *ChannelClientPool {
+func (cli *pooledClient) Do(fn func(Client) error) error {
+	err := fn(cli.Client)
+	if isUnusableTransportError(err) {
+		cli.MarkUnusable()
+	}
+	return err
+}
+
+// isUnusableTransportError reports whether err indicates the underlying
+// connection is no longer usable: a broken transport (net.OpError), an
+// unexpected EOF, or a thrift.TTransportException carrying one of the
+// broken-pipe/timeout/not-open codes.
+func isUnusableTransportError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == io.EOF {
+		return true
+	}
+	if _, ok := err.(*net.OpError); ok {
+		return true
+	}
+	if te, ok := err.(thrift.TTransportException); ok {
+		switch te.TypeId() {
+		case thrift.UNKNOWN_TRANSPORT_EXCEPTION, thrift.NOT_OPEN, thrift.TIMED_OUT, thrift.END_OF_FILE:
+			return true
+		}
+	}
+	return false
+}
+
+func NewChannelClientPool(maxIdle, maxOpen uint32, serverSet ServerSet, connectTimeout, readTimeout time.Duration, clientFactory ClientFactory, opts ...PoolOption) *ChannelClientPool {
+	servers := serverSet.Servers()
 	pool := &ChannelClientPool{
-		clients:        make(chan Client, maxIdle),
+		clients:        make(map[string]chan *idleClient),
+		outstanding:    make(map[string]*int32),
 		maxIdle:        maxIdle,
 		maxOpen:        maxOpen,
+		serverSet:      serverSet,
 		servers:        servers,
+		policy:         LeastActivePolicy{},
 		connectTimeout: connectTimeout,
 		readTimeout:    readTimeout,
 		clientFactory:  clientFactory,
 	}
+	for _, opt := range opts {
+		opt(pool)
+	}
+	for _, server := range servers {
+		pool.clients[server] = make(chan *idleClient, maxIdle)
+		var count int32
+		pool.outstanding[server] = &count
+	}
+	if pool.maxIdleTime > 0 || pool.maxLifetime > 0 {
+		pool.reapStop = make(chan struct{})
+		pool.reapDone = make(chan struct{})
+		go pool.reapLoop()
+	}
+	if notify := serverSet.Notify(); notify != nil {
+		pool.watchStop = make(chan struct{})
+		pool.watchDone = make(chan struct{})
+		go pool.watchServerSet(notify)
+	}
 	return pool
 }
 
+// watchServerSet applies membership updates pushed by the ServerSet until
+// the pool is closed or the notify channel is closed.
+func (pool *ChannelClientPool) watchServerSet(notify <-chan []string) {
+	defer close(pool.watchDone)
+	for {
+		select {
+		case servers, ok := <-notify:
+			if !ok {
+				return
+			}
+			pool.updateServers(servers)
+		case <-pool.watchStop:
+			return
+		}
+	}
+}
+
+// updateServers swaps in a new server membership list, dropping any
+// idle clients pooled against hosts that are no longer present.
+func (pool *ChannelClientPool) updateServers(servers []string) {
+	newSet := make(map[string]bool, len(servers))
+	for _, server := range servers {
+		newSet[server] = true
+	}
+
+	pool.mu.Lock()
+	if pool.clients == nil {
+		// Pool has been Close()d; there is nothing left to update.
+		pool.mu.Unlock()
+		return
+	}
+	pool.servers = servers
+	var removed []chan *idleClient
+	for server, clients := range pool.clients {
+		if !newSet[server] {
+			removed = append(removed, clients)
+			delete(pool.clients, server)
+			delete(pool.outstanding, server)
+		}
+	}
+	for server := range newSet {
+		if _, ok := pool.clients[server]; !ok {
+			pool.clients[server] = make(chan *idleClient, pool.maxIdle)
+			var count int32
+			pool.outstanding[server] = &count
+		}
+	}
+	pool.mu.Unlock()
+
+	for _, clients := range removed {
+	drain:
+		for {
+			select {
+			case conn := <-clients:
+				pool.closeClient(conn.transport)
+			default:
+				break drain
+			}
+		}
+	}
+}
+
+// reapInterval returns how often the background reaper sweeps idle clients
+// for expiry, derived from whichever bound is tighter.
+func (pool *ChannelClientPool) reapInterval() time.Duration {
+	interval := pool.maxIdleTime
+	if interval == 0 || (pool.maxLifetime > 0 && pool.maxLifetime < interval) {
+		interval = pool.maxLifetime
+	}
+	interval /= 2
+	if interval <= 0 {
+		interval = time.Second
+	}
+	return interval
+}
+
+// reapLoop periodically evicts idle clients that have exceeded maxIdleTime
+// or maxLifetime, until the pool is closed.
+func (pool *ChannelClientPool) reapLoop() {
+	defer close(pool.reapDone)
+	ticker := time.NewTicker(pool.reapInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			pool.reapExpired()
+		case <-pool.reapStop:
+			return
+		}
+	}
+}
+
+// reapExpired drains every host's idle channel, closing expired clients and
+// putting the still-fresh ones back.
+func (pool *ChannelClientPool) reapExpired() {
+	pool.mu.Lock()
+	clientsByHost := make(map[string]chan *idleClient, len(pool.clients))
+	for server, clients := range pool.clients {
+		clientsByHost[server] = clients
+	}
+	pool.mu.Unlock()
+
+	now := time.Now()
+	for _, clients := range clientsByHost {
+		fresh := make([]*idleClient, 0, len(clients))
+	drain:
+		for {
+			select {
+			case conn := <-clients:
+				if pool.expired(conn, now) {
+					pool.closeClient(conn.transport)
+				} else {
+					fresh = append(fresh, conn)
+				}
+			default:
+				break drain
+			}
+		}
+		for _, conn := range fresh {
+			select {
+			case clients <- conn:
+			default:
+				pool.closeClient(conn.transport)
+			}
+		}
+	}
+}
+
+func (pool *ChannelClientPool) expired(conn *idleClient, now time.Time) bool {
+	if pool.maxIdleTime > 0 && now.Sub(conn.lastUsedAt) > pool.maxIdleTime {
+		return true
+	}
+	if pool.maxLifetime > 0 && now.Sub(conn.createdAt) > pool.maxLifetime {
+		return true
+	}
+	return false
+}
+
+// SetSelectionPolicy overrides the pool's server selection policy. Callers
+// should set this before the pool is used concurrently.
+func (pool *ChannelClientPool) SetSelectionPolicy(policy SelectionPolicy) {
+	pool.policy = policy
+}
+
 func (pool *ChannelClientPool) Get() (cli PooledClient, err error) {
-	rawCli, err := pool.getFromPool()
+	servers := pool.currentServers()
+	if len(servers) == 0 {
+		return nil, ErrNoServers
+	}
+	server := pool.policy.Select(servers, pool.outstandingCount)
+
+	conn, err := pool.getFromPool(server)
 	if err == ErrPoolClosed {
 		return nil, err
 	}
-	if rawCli == nil {
-		rawCli, err = pool.openClient()
-		if err != nil {
-			return
+	if conn != nil && pool.pingFunc != nil && pool.pingFunc(conn.client) != nil {
+		pool.closeClient(conn.transport)
+		conn = nil
+	}
+	if conn == nil {
+		cwt, openErr := pool.openClient(server)
+		if openErr != nil {
+			return nil, openErr
 		}
+		now := time.Now()
+		conn = &idleClient{client: cwt.Client, transport: cwt.Transport, createdAt: now, lastUsedAt: now}
 	}
+	pool.incOutstanding(server, 1)
 	cli = &pooledClient{
-		Client: rawCli,
-		pool:   pool,
+		Client:    conn.client,
+		pool:      pool,
+		server:    server,
+		transport: conn.transport,
+		createdAt: conn.createdAt,
 	}
-	return
+	return cli, nil
+}
+
+// GetContext behaves like Get, except that when maxOpen is reached it
+// blocks until a maxOpen slot is freed (a checked-out client is closed
+// rather than returned to the idle pool) or ctx is done, instead of
+// immediately returning ErrPoolMaxOpenReached. A client returned to the
+// idle pool while it waits does not wake it.
+func (pool *ChannelClientPool) GetContext(ctx context.Context) (cli PooledClient, err error) {
+	servers := pool.currentServers()
+	if len(servers) == 0 {
+		return nil, ErrNoServers
+	}
+	server := pool.policy.Select(servers, pool.outstandingCount)
+
+	conn, err := pool.getFromPool(server)
+	if err == ErrPoolClosed {
+		return nil, err
+	}
+	if conn != nil && pool.pingFunc != nil && pool.pingFunc(conn.client) != nil {
+		pool.closeClient(conn.transport)
+		conn = nil
+	}
+	if conn == nil {
+		if pool.maxOpen != 0 {
+			if err = pool.acquireOpenSlot(ctx); err != nil {
+				return nil, err
+			}
+		}
+		cwt, openErr := pool.dialClient(server)
+		if openErr != nil {
+			if pool.maxOpen != 0 {
+				atomic.AddUint32(&pool.opened, ^uint32(0))
+				pool.wakeNextWaiter()
+			}
+			return nil, openErr
+		}
+		now := time.Now()
+		conn = &idleClient{client: cwt.Client, transport: cwt.Transport, createdAt: now, lastUsedAt: now}
+	}
+	pool.incOutstanding(server, 1)
+	cli = &pooledClient{
+		Client:    conn.client,
+		pool:      pool,
+		server:    server,
+		transport: conn.transport,
+		createdAt: conn.createdAt,
+	}
+	return cli, nil
+}
+
+// currentServers returns a snapshot of the pool's current server membership.
+func (pool *ChannelClientPool) currentServers() []string {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	return pool.servers
 }
 
 func (pool *ChannelClientPool) Close() (err error) {
 	pool.mu.Lock()
-	clients := pool.clients
+	clientsByHost := pool.clients
 	pool.clients = nil
 	pool.mu.Unlock()
-	for {
-		select {
-		case rawCli := <-clients:
-			curErr := pool.closeClient(rawCli)
-			if err == nil {
-				err = curErr
+
+	if pool.reapStop != nil {
+		close(pool.reapStop)
+		<-pool.reapDone
+	}
+	if pool.watchStop != nil {
+		close(pool.watchStop)
+		<-pool.watchDone
+	}
+
+	for _, clients := range clientsByHost {
+	drain:
+		for {
+			select {
+			case conn := <-clients:
+				curErr := pool.closeClient(conn.transport)
+				if err == nil {
+					err = curErr
+				}
+			default:
+				break drain
 			}
-		default:
-			return
 		}
 	}
+	return
 }
 
 func (pool *ChannelClientPool) Size() int {
 	pool.mu.Lock()
 	defer pool.mu.Unlock()
-	return len(pool.clients)
+	size := 0
+	for _, clients := range pool.clients {
+		size += len(clients)
+	}
+	return size
 }
 
-func (pool *ChannelClientPool) getFromPool() (rawCli Client, err error) {
+// outstandingCount returns the number of clients of server currently checked
+// out of the pool.
+func (pool *ChannelClientPool) outstandingCount(server string) int32 {
 	pool.mu.Lock()
-	defer pool.mu.Unlock()
-	if pool.clients == nil {
-		return nil, ErrPoolClosed
-	}
-	select {
-	case rawCli = <-pool.clients:
-		return
-	default:
-		return nil, errNoPooledClient
+	counter, ok := pool.outstanding[server]
+	pool.mu.Unlock()
+	if !ok {
+		return 0
 	}
+	return atomic.LoadInt32(counter)
 }
 
-func (pool *ChannelClientPool) closePooledClient(cli *pooledClient) error {
-	if cli.unusable {
-		return pool.closeClient(cli.Client)
+func (pool *ChannelClientPool) incOutstanding(server string, delta int32) {
+	pool.mu.Lock()
+	counter, ok := pool.outstanding[server]
+	if !ok {
+		var count int32
+		counter = &count
+		pool.outstanding[server] = counter
 	}
+	pool.mu.Unlock()
+	atomic.AddInt32(counter, delta)
+}
 
+func (pool *ChannelClientPool) getFromPool(server string) (conn *idleClient, err error) {
 	pool.mu.Lock()
-	if pool.clients != nil {
+	if pool.clients == nil {
+		pool.mu.Unlock()
+		return nil, ErrPoolClosed
+	}
+	clients, ok := pool.clients[server]
+	if !ok {
+		clients = make(chan *idleClient, pool.maxIdle)
+		pool.clients[server] = clients
+	}
+	pool.mu.Unlock()
+
+	now := time.Now()
+	for {
 		select {
-		case pool.clients <- cli.Client:
-			cli.Client = nil
+		case conn = <-clients:
+			if pool.expired(conn, now) {
+				pool.closeClient(conn.transport)
+				continue
+			}
+			return conn, nil
 		default:
+			return nil, errNoPooledClient
+		}
+	}
+}
+
+// closePooledClient returns cli's connection to the idle pool, unless cli is
+// marked unusable or cli.server is no longer a member of the pool (dropped
+// by a ServerSet update while cli was checked out). In the latter case the
+// connection is simply closed instead of resurrecting a host bucket that
+// updateServers already tore down, which would otherwise leak the socket
+// and leave a stale outstanding counter behind for the host.
+func (pool *ChannelClientPool) closePooledClient(cli *pooledClient) error {
+	pool.mu.Lock()
+	if counter, ok := pool.outstanding[cli.server]; ok {
+		atomic.AddInt32(counter, -1)
+	}
+	if !cli.unusable && pool.clients != nil {
+		if clients, ok := pool.clients[cli.server]; ok {
+			conn := &idleClient{client: cli.Client, transport: cli.transport, createdAt: cli.createdAt, lastUsedAt: time.Now()}
+			select {
+			case clients <- conn:
+				cli.Client = nil
+				cli.transport = nil
+			default:
+			}
 		}
 	}
 	pool.mu.Unlock()
 
-	return pool.closeClient(cli.Client)
+	return pool.closeClient(cli.transport)
 }
 
-func (pool *ChannelClientPool) openClient() (cli Client, err error) {
-	if pool.maxOpen != 0 && atomic.LoadUint32(&pool.opened) >= pool.maxOpen {
-		return nil, ErrPoolMaxOpenReached
+// openClient dials a fresh connection to server, first claiming a maxOpen
+// slot (if the pool enforces one) via tryAcquireOpenSlot so that concurrent
+// callers can't race the check-then-increment and overshoot the limit.
+func (pool *ChannelClientPool) openClient(server string) (cwt ClientWithTransport, err error) {
+	if pool.maxOpen != 0 && !pool.tryAcquireOpenSlot() {
+		return ClientWithTransport{}, ErrPoolMaxOpenReached
 	}
+	cwt, err = pool.dialClient(server)
+	if err != nil {
+		if pool.maxOpen != 0 {
+			atomic.AddUint32(&pool.opened, ^uint32(0))
+			pool.wakeNextWaiter()
+		}
+		return ClientWithTransport{}, err
+	}
+	return cwt, nil
+}
 
-	server := pool.servers[rand.Int()%len(pool.servers)]
-	var socket *thrift.TSocket
-	if socket, err = thrift.NewTSocket(server); err != nil {
-		return
+// dialClient dials a fresh connection to server via the configured Dialer
+// (TCPDialer by default), runs it through the TTransportFactory if one is
+// set, and hands the result to clientFactory. maxOpen bookkeeping is not
+// handled here; callers that care about the limit account for it
+// themselves (see openClient and acquireOpenSlot).
+func (pool *ChannelClientPool) dialClient(server string) (cwt ClientWithTransport, err error) {
+	dialer := pool.dialer
+	if dialer == nil {
+		dialer = TCPDialer
 	}
-	socket.SetTimeout(pool.connectTimeout)
-	if err = socket.Open(); err != nil {
-		return
+	transport, err := dialer(server, pool.connectTimeout, pool.readTimeout)
+	if err != nil {
+		return ClientWithTransport{}, err
 	}
-	socket.SetTimeout(pool.readTimeout)
-	if pool.maxOpen != 0 {
-		atomic.AddUint32(&pool.opened, 1)
+	if pool.transportFactory != nil {
+		transport = pool.transportFactory.GetTransport(transport)
 	}
-	return pool.clientFactory(socket), nil
+	return pool.clientFactory(transport), nil
 }
 
-func (pool *ChannelClientPool) closeClient(cli Client) (err error) {
-	if cli == nil {
+// closeClient closes transport and, if the pool enforces maxOpen, releases
+// the slot transport held and wakes the next GetContext waiter.
+func (pool *ChannelClientPool) closeClient(transport thrift.TTransport) (err error) {
+	if transport == nil {
 		return nil
 	}
 	if pool.maxOpen != 0 {
 		atomic.AddUint32(&pool.opened, ^uint32(0))
+		pool.wakeNextWaiter()
 	}
-	if v := reflect.ValueOf(cli).Elem().FieldByName("Transport"); !v.IsValid() {
-		return ErrClientMissingTransportField
-	} else if v.IsNil() {
-		return ErrClientNilTransportField
-	} else {
-		if transport, ok := v.Interface().(thrift.TTransport); !ok {
-			panic(v)
-		} else {
-			return transport.Close()
+	return transport.Close()
+}
+
+// tryAcquireOpenSlot claims a maxOpen slot without blocking, returning false
+// if the limit is already reached. The check and the increment happen under
+// the same lock acquireOpenSlot uses, so concurrent callers (from Get and
+// GetContext alike) can't both pass the check before either claims the slot.
+func (pool *ChannelClientPool) tryAcquireOpenSlot() bool {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if atomic.LoadUint32(&pool.opened) >= pool.maxOpen {
+		return false
+	}
+	atomic.AddUint32(&pool.opened, 1)
+	return true
+}
+
+// acquireOpenSlot blocks until a maxOpen slot is available or ctx is done,
+// claiming the slot (incrementing opened) before returning nil. Waiters are
+// queued FIFO and woken one at a time as slots are released by closeClient.
+func (pool *ChannelClientPool) acquireOpenSlot(ctx context.Context) error {
+	for {
+		pool.mu.Lock()
+		if atomic.LoadUint32(&pool.opened) < pool.maxOpen {
+			atomic.AddUint32(&pool.opened, 1)
+			pool.mu.Unlock()
+			return nil
+		}
+		waiter := make(chan struct{}, 1)
+		pool.waiters = append(pool.waiters, waiter)
+		pool.mu.Unlock()
+
+		select {
+		case <-waiter:
+			// A slot was freed; loop back and try to claim it.
+		case <-ctx.Done():
+			pool.removeWaiter(waiter)
+			return ctx.Err()
+		}
+	}
+}
+
+// wakeNextWaiter signals the longest-waiting acquireOpenSlot caller, if any,
+// that it should recheck whether a slot is now available.
+func (pool *ChannelClientPool) wakeNextWaiter() {
+	pool.mu.Lock()
+	if len(pool.waiters) == 0 {
+		pool.mu.Unlock()
+		return
+	}
+	waiter := pool.waiters[0]
+	pool.waiters = pool.waiters[1:]
+	pool.mu.Unlock()
+	waiter <- struct{}{}
+}
+
+func (pool *ChannelClientPool) removeWaiter(waiter chan struct{}) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	for i, w := range pool.waiters {
+		if w == waiter {
+			pool.waiters = append(pool.waiters[:i], pool.waiters[i+1:]...)
+			return
 		}
 	}
 }
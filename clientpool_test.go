@@ -1,6 +1,8 @@
 package thrift_client_pool
 
 import (
+	"context"
+	"errors"
 	"testing"
 
 	"net"
@@ -27,16 +29,38 @@ func (h *ExampleHandler) AddTimeout(num1 int32, num2 int32, client_timeout_ms in
 	return num1 + num2, nil
 }
 
+func TestLeastActivePolicySelectsFewestOutstanding(t *testing.T) {
+	servers := []string{"a", "b", "c"}
+	outstanding := map[string]int32{"a": 2, "b": 0, "c": 1}
+	policy := LeastActivePolicy{}
+	if got := policy.Select(servers, func(server string) int32 { return outstanding[server] }); got != "b" {
+		t.Errorf("expected \"b\", got %q", got)
+	}
+}
+
+func TestRoundRobinPolicyCyclesInOrder(t *testing.T) {
+	servers := []string{"a", "b", "c"}
+	policy := &RoundRobinPolicy{}
+	for i, want := range []string{"a", "b", "c", "a", "b", "c"} {
+		if got := policy.Select(servers, nil); got != want {
+			t.Errorf("call %d: got %q, want %q", i, got, want)
+		}
+	}
+}
+
 func TestGet(t *testing.T) {
 	servers := []string{
 		serverAddr.String(),
 	}
 	var maxIdle uint32 = 1
 	var timeoutMs int32 = 5
-	pool := NewChannelClientPool(maxIdle, 0, servers, 0, time.Duration(timeoutMs)*time.Millisecond,
-		func(openedSocket thrift.TTransport) Client {
+	pool := NewChannelClientPool(maxIdle, 0, NewStaticServerSet(servers), 0, time.Duration(timeoutMs)*time.Millisecond,
+		func(openedSocket thrift.TTransport) ClientWithTransport {
 			transport := transportFactory.GetTransport(openedSocket)
-			return example.NewExampleClientFactory(transport, protocolFactory)
+			return ClientWithTransport{
+				Client:    example.NewExampleClientFactory(transport, protocolFactory),
+				Transport: transport,
+			}
 		},
 	)
 	func() {
@@ -61,15 +85,440 @@ func TestGet(t *testing.T) {
 			t.Error(err)
 		}
 		defer pooledClient.Close()
-		rawClient := pooledClient.RawClient().(*example.ExampleClient)
-		if _, err := rawClient.AddTimeout(1, 2, timeoutMs); err == nil {
+		// Do() is the supported call path: it auto-detects the transport
+		// timeout below and marks the client unusable, instead of the
+		// caller having to remember to call MarkUnusable() itself.
+		err = pooledClient.Do(func(cli Client) error {
+			_, err := cli.(*example.ExampleClient).AddTimeout(1, 2, timeoutMs)
+			return err
+		})
+		if err == nil {
 			t.Error("timeout expected")
-		} else {
-			pooledClient.MarkUnusable()
 		}
 	}()
 }
 
+func TestPingFuncRedialsOnFailure(t *testing.T) {
+	servers := []string{serverAddr.String()}
+	var pingCalls int
+	pool := NewChannelClientPool(1, 0, NewStaticServerSet(servers), 0, time.Second,
+		func(openedSocket thrift.TTransport) ClientWithTransport {
+			transport := transportFactory.GetTransport(openedSocket)
+			return ClientWithTransport{
+				Client:    example.NewExampleClientFactory(transport, protocolFactory),
+				Transport: transport,
+			}
+		},
+		WithPingFunc(func(cli Client) error {
+			pingCalls++
+			if pingCalls == 1 {
+				return errors.New("stale connection")
+			}
+			return nil
+		}),
+	)
+	defer pool.Close()
+
+	first, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := first.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if pool.Size() != 1 {
+		t.Fatalf("expected the first client to be pooled idle, got %d", pool.Size())
+	}
+
+	second, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	if pingCalls != 1 {
+		t.Errorf("expected PingFunc to be invoked once against the pooled client, got %d", pingCalls)
+	}
+	rawClient, ok := second.RawClient().(*example.ExampleClient)
+	if !ok {
+		t.Fatal("convert to raw client failed")
+	}
+	if v, err := rawClient.Add(1, 2); err != nil {
+		t.Error(err)
+	} else if v != 3 {
+		t.Error("call rpc failed")
+	}
+	if pool.Size() != 0 {
+		t.Errorf("expected the failed-ping client to be closed rather than left idle, got %d", pool.Size())
+	}
+}
+
+// fakeServerSet is a ServerSet whose membership can be pushed on demand,
+// for exercising ChannelClientPool's discovery-update path without a real
+// discovery backend.
+type fakeServerSet struct {
+	servers []string
+	notify  chan []string
+}
+
+func (s *fakeServerSet) Servers() []string {
+	return s.servers
+}
+
+func (s *fakeServerSet) Notify() <-chan []string {
+	return s.notify
+}
+
+func noopClientFactory(transport thrift.TTransport) ClientWithTransport {
+	return ClientWithTransport{Transport: transport}
+}
+
+func TestServerSetUpdateDrainsRemovedHost(t *testing.T) {
+	set := &fakeServerSet{servers: []string{"a", "b"}, notify: make(chan []string, 1)}
+	pool := NewChannelClientPool(1, 0, set, 0, time.Second, noopClientFactory)
+	defer pool.Close()
+
+	set.notify <- []string{"b", "c"}
+	deadline := time.Now().Add(time.Second)
+	for {
+		if servers := pool.currentServers(); len(servers) == 2 && servers[0] != "a" && servers[1] != "a" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("updateServers did not apply in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	pool.mu.Lock()
+	_, hasA := pool.clients["a"]
+	_, hasC := pool.clients["c"]
+	pool.mu.Unlock()
+	if hasA {
+		t.Error("expected host \"a\" to be dropped from the pool")
+	}
+	if !hasC {
+		t.Error("expected host \"c\" to be added to the pool")
+	}
+}
+
+// Regression test: updateServers used to panic with "assignment to entry
+// in nil map" when a ServerSet.Notify() push raced past Close() setting
+// pool.clients to nil.
+func TestUpdateServersAfterCloseDoesNotPanic(t *testing.T) {
+	set := &fakeServerSet{servers: []string{"a"}}
+	pool := NewChannelClientPool(1, 0, set, 0, time.Second, noopClientFactory)
+	if err := pool.Close(); err != nil {
+		t.Fatal(err)
+	}
+	pool.updateServers([]string{"a", "b"})
+}
+
+// Regression test: closePooledClient used to resurrect a host bucket (and
+// outstanding counter) that updateServers had already torn down, orphaning
+// the connection instead of closing it.
+func TestClosePooledClientAfterHostRemovedDoesNotResurrectBucket(t *testing.T) {
+	server := serverAddr.String()
+	set := &fakeServerSet{servers: []string{server}, notify: make(chan []string, 1)}
+	pool := NewChannelClientPool(1, 0, set, 0, time.Second,
+		func(openedSocket thrift.TTransport) ClientWithTransport {
+			transport := transportFactory.GetTransport(openedSocket)
+			return ClientWithTransport{
+				Client:    example.NewExampleClientFactory(transport, protocolFactory),
+				Transport: transport,
+			}
+		},
+	)
+	defer pool.Close()
+
+	pooledClient, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	set.notify <- nil
+	deadline := time.Now().Add(time.Second)
+	for len(pool.currentServers()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("updateServers did not apply in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := pooledClient.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	pool.mu.Lock()
+	_, hasClients := pool.clients[server]
+	_, hasOutstanding := pool.outstanding[server]
+	pool.mu.Unlock()
+	if hasClients {
+		t.Error("closePooledClient resurrected the removed host's client bucket")
+	}
+	if hasOutstanding {
+		t.Error("closePooledClient resurrected the removed host's outstanding counter")
+	}
+	if pool.Size() != 0 {
+		t.Errorf("expected the connection to be closed rather than pooled, got %d idle clients", pool.Size())
+	}
+}
+
+func TestMaxIdleTimeEvictsStaleClient(t *testing.T) {
+	servers := []string{serverAddr.String()}
+	pool := NewChannelClientPool(1, 0, NewStaticServerSet(servers), 0, time.Second,
+		func(openedSocket thrift.TTransport) ClientWithTransport {
+			transport := transportFactory.GetTransport(openedSocket)
+			return ClientWithTransport{
+				Client:    example.NewExampleClientFactory(transport, protocolFactory),
+				Transport: transport,
+			}
+		},
+		WithMaxIdleTime(10*time.Millisecond),
+	)
+	defer pool.Close()
+
+	pooledClient, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pooledClient.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if pool.Size() != 1 {
+		t.Fatalf("expected 1 idle client pooled, got %d", pool.Size())
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for pool.Size() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("background reaper did not evict the stale idle client in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestGetContextBlocksUntilSlotFreed(t *testing.T) {
+	servers := []string{serverAddr.String()}
+	pool := NewChannelClientPool(0, 1, NewStaticServerSet(servers), 0, time.Second,
+		func(openedSocket thrift.TTransport) ClientWithTransport {
+			transport := transportFactory.GetTransport(openedSocket)
+			return ClientWithTransport{
+				Client:    example.NewExampleClientFactory(transport, protocolFactory),
+				Transport: transport,
+			}
+		},
+	)
+	defer pool.Close()
+
+	held, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pool.Get(); err != ErrPoolMaxOpenReached {
+		t.Fatalf("expected ErrPoolMaxOpenReached with the slot held, got %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		waited, err := pool.GetContext(context.Background())
+		if err != nil {
+			done <- err
+			return
+		}
+		done <- waited.Close()
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("GetContext returned before the slot was freed: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := held.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("GetContext failed after slot was freed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("GetContext did not unblock after the slot was freed")
+	}
+}
+
+// Regression test: concurrent Get() calls used to race the check-then-dial-
+// then-increment on pool.opened and could all pass the maxOpen check before
+// any of them incremented it, overshooting the limit.
+func TestGetDoesNotOvershootMaxOpen(t *testing.T) {
+	const maxOpen = 2
+	const attempts = 8
+	servers := []string{serverAddr.String()}
+	slowDialer := func(server string, connectTimeout, readTimeout time.Duration) (thrift.TTransport, error) {
+		time.Sleep(10 * time.Millisecond)
+		return TCPDialer(server, connectTimeout, readTimeout)
+	}
+	pool := NewChannelClientPool(0, maxOpen, NewStaticServerSet(servers), 0, time.Second,
+		func(openedSocket thrift.TTransport) ClientWithTransport {
+			transport := transportFactory.GetTransport(openedSocket)
+			return ClientWithTransport{
+				Client:    example.NewExampleClientFactory(transport, protocolFactory),
+				Transport: transport,
+			}
+		},
+		WithDialer(slowDialer),
+	)
+	defer pool.Close()
+
+	start := make(chan struct{})
+	results := make(chan error, attempts)
+	clients := make(chan PooledClient, attempts)
+	for i := 0; i < attempts; i++ {
+		go func() {
+			<-start
+			cli, err := pool.Get()
+			if err != nil {
+				results <- err
+				return
+			}
+			clients <- cli
+			results <- nil
+		}()
+	}
+	close(start)
+
+	var succeeded, rejected int
+	for i := 0; i < attempts; i++ {
+		switch err := <-results; err {
+		case nil:
+			succeeded++
+		case ErrPoolMaxOpenReached:
+			rejected++
+		default:
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	close(clients)
+	for cli := range clients {
+		cli.Close()
+	}
+
+	if succeeded > maxOpen {
+		t.Errorf("expected at most %d successful Get() calls while maxOpen is enforced, got %d", maxOpen, succeeded)
+	}
+	if succeeded+rejected != attempts {
+		t.Errorf("expected every Get() call to either succeed or hit ErrPoolMaxOpenReached, got %d successes + %d rejections for %d attempts", succeeded, rejected, attempts)
+	}
+}
+
+// countingTransportFactory wraps a thrift.TTransportFactory to record how
+// many times the pool asked it to wrap a dialed transport.
+type countingTransportFactory struct {
+	inner thrift.TTransportFactory
+	calls int
+}
+
+func (f *countingTransportFactory) GetTransport(trans thrift.TTransport) thrift.TTransport {
+	f.calls++
+	return f.inner.GetTransport(trans)
+}
+
+func TestWithDialerAndTransportFactoryAreApplied(t *testing.T) {
+	servers := []string{serverAddr.String()}
+	var dialCalls int
+	var dialedServer string
+	dialer := func(server string, connectTimeout, readTimeout time.Duration) (thrift.TTransport, error) {
+		dialCalls++
+		dialedServer = server
+		return TCPDialer(server, connectTimeout, readTimeout)
+	}
+	wrappingFactory := &countingTransportFactory{inner: transportFactory}
+
+	pool := NewChannelClientPool(1, 0, NewStaticServerSet(servers), 0, time.Second,
+		func(transport thrift.TTransport) ClientWithTransport {
+			return ClientWithTransport{
+				Client:    example.NewExampleClientFactory(transport, protocolFactory),
+				Transport: transport,
+			}
+		},
+		WithDialer(dialer),
+		WithTransportFactory(wrappingFactory),
+	)
+	defer pool.Close()
+
+	pooledClient, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pooledClient.Close()
+
+	if dialCalls != 1 {
+		t.Errorf("expected the custom Dialer to be called once, got %d", dialCalls)
+	}
+	if dialedServer != servers[0] {
+		t.Errorf("expected Dialer to be called with %q, got %q", servers[0], dialedServer)
+	}
+	if wrappingFactory.calls != 1 {
+		t.Errorf("expected the custom TTransportFactory to be applied once, got %d", wrappingFactory.calls)
+	}
+
+	rawClient, ok := pooledClient.RawClient().(*example.ExampleClient)
+	if !ok {
+		t.Fatal("convert to raw client failed")
+	}
+	if v, err := rawClient.Add(1, 2); err != nil {
+		t.Error(err)
+	} else if v != 3 {
+		t.Error("call rpc failed")
+	}
+}
+
+func TestWrapLegacyClientFactoryReflectsTransport(t *testing.T) {
+	servers := []string{serverAddr.String()}
+	legacy := LegacyClientFactory(func(transport thrift.TTransport) Client {
+		wrapped := transportFactory.GetTransport(transport)
+		return example.NewExampleClientFactory(wrapped, protocolFactory)
+	})
+	pool := NewChannelClientPool(1, 0, NewStaticServerSet(servers), 0, time.Second, WrapLegacyClientFactory(legacy))
+	defer pool.Close()
+
+	pooledClient, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pooledClient.Close()
+
+	rawClient, ok := pooledClient.RawClient().(*example.ExampleClient)
+	if !ok {
+		t.Fatal("convert to raw client failed")
+	}
+	if v, err := rawClient.Add(1, 2); err != nil {
+		t.Error(err)
+	} else if v != 3 {
+		t.Error("call rpc failed")
+	}
+}
+
+// fakeClientMissingTransport and fakeClientNilTransport exercise
+// reflectClientTransport's fallback paths for generated-client shapes that
+// don't match Apache Thrift's usual "Transport" field.
+type fakeClientMissingTransport struct{}
+
+type fakeClientNilTransport struct {
+	Transport thrift.TTransport
+}
+
+func TestReflectClientTransportErrors(t *testing.T) {
+	if _, err := reflectClientTransport(&fakeClientMissingTransport{}); err != ErrClientMissingTransportField {
+		t.Errorf("expected ErrClientMissingTransportField, got %v", err)
+	}
+	if _, err := reflectClientTransport(&fakeClientNilTransport{}); err != ErrClientNilTransportField {
+		t.Errorf("expected ErrClientNilTransportField, got %v", err)
+	}
+}
+
 func TestMain(m *testing.M) {
 	transportFactory = thrift.NewTBufferedTransportFactory(8192)
 	transportFactory = thrift.NewTFramedTransportFactory(transportFactory)